@@ -17,6 +17,32 @@ type Config struct {
 
 	UserSuffix      string
 	RefreshInterval *time.Duration
+
+	// TxMaxRetries is the number of attempts RunInTx will make against a
+	// transaction before giving up on a retryable Postgres error.
+	TxMaxRetries int
+
+	// TxRetryBaseDelay is the base delay used to compute the capped
+	// exponential backoff between RunInTx attempts.
+	TxRetryBaseDelay time.Duration
+
+	// TxRetryMaxDelay caps the exponential backoff between RunInTx attempts
+	// so a large TxMaxRetries can't grow the final wait unreasonably long.
+	TxRetryMaxDelay time.Duration
+
+	// BatchChunkSize is the number of users processed per worker when
+	// UpdateUserDataUsageBatch fans a batch out across its worker pool.
+	BatchChunkSize int
+
+	// BatchConcurrency is the number of workers UpdateUserDataUsageBatch
+	// runs concurrently when processing a batch.
+	BatchConcurrency int
+
+	// SnapshotMode, when enabled, reads ICAT usages inside a REPEATABLE
+	// READ, read-only transaction and has UpdateUserDataUsageBatch commit
+	// its DE work once, after every chunk of the batch has published. The
+	// exported snapshot ID is not stored with the readings.
+	SnapshotMode bool
 }
 
 func NewFromViper(cfg *viper.Viper) (*Config, error) {
@@ -24,6 +50,17 @@ func NewFromViper(cfg *viper.Viper) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	txRetryBaseDelay, err := time.ParseDuration(cfg.GetString("dataUsageApi.txRetryBaseDelay"))
+	if err != nil {
+		return nil, err
+	}
+
+	txRetryMaxDelay, err := time.ParseDuration(cfg.GetString("dataUsageApi.txRetryMaxDelay"))
+	if err != nil {
+		return nil, err
+	}
+
 	c := &Config{
 		DBURI:             cfg.GetString("db.uri"),
 		DBSchema:          cfg.GetString("db.schema"),
@@ -32,6 +69,12 @@ func NewFromViper(cfg *viper.Viper) (*Config, error) {
 		RootResourceNames: cfg.GetStringSlice("icat.rootResources"),
 		UserSuffix:        cfg.GetString("users.domain"),
 		RefreshInterval:   &ri,
+		TxMaxRetries:      cfg.GetInt("dataUsageApi.txMaxRetries"),
+		TxRetryBaseDelay:  txRetryBaseDelay,
+		TxRetryMaxDelay:   txRetryMaxDelay,
+		BatchChunkSize:    cfg.GetInt("dataUsageApi.batchChunkSize"),
+		BatchConcurrency:  cfg.GetInt("dataUsageApi.batchConcurrency"),
+		SnapshotMode:      cfg.GetBool("dataUsageApi.snapshotMode"),
 	}
 
 	err = c.Validate()
@@ -70,5 +113,25 @@ func (c *Config) Validate() error {
 		return errors.New("refresh interval must be set")
 	}
 
+	if c.TxMaxRetries <= 0 {
+		return errors.New("dataUsageApi.txMaxRetries must be greater than zero")
+	}
+
+	if c.TxRetryBaseDelay <= 0 {
+		return errors.New("dataUsageApi.txRetryBaseDelay must be greater than zero")
+	}
+
+	if c.TxRetryMaxDelay <= 0 {
+		return errors.New("dataUsageApi.txRetryMaxDelay must be greater than zero")
+	}
+
+	if c.BatchChunkSize <= 0 {
+		return errors.New("dataUsageApi.batchChunkSize must be greater than zero")
+	}
+
+	if c.BatchConcurrency <= 0 {
+		return errors.New("dataUsageApi.batchConcurrency must be greater than zero")
+	}
+
 	return nil
 }
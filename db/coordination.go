@@ -3,11 +3,16 @@ package db
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"math"
+	"time"
 
 	"github.com/cyverse-de/data-usage-api/config"
 	"github.com/cyverse-de/data-usage-api/natsconn"
 	"github.com/cyverse-de/data-usage-api/util"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 
 	"go.opentelemetry.io/otel"
 )
@@ -18,11 +23,19 @@ type BothDatabases struct {
 	configuration *config.Config
 	nc            *natsconn.Connector
 
+	// Deprecated: call WithDETx instead, which begins, commits and rolls
+	// back its transaction without requiring callers to remember to defer
+	// anything.
 	DERollback func()
-	DECommit   func() error
+	// Deprecated: call WithDETx instead.
+	DECommit func() error
 
+	// Deprecated: call WithICATTx instead, which begins, commits and rolls
+	// back its transaction without requiring callers to remember to defer
+	// anything.
 	ICATRollback func()
-	ICATCommit   func() error
+	// Deprecated: call WithICATTx instead.
+	ICATCommit func() error
 
 	detx   *DEDatabase
 	icattx *ICATDatabase
@@ -32,6 +45,7 @@ func NewBoth(dedb DatabaseTxAccessor, icatdb DatabaseTxAccessor, config *config.
 	return &BothDatabases{deconn: dedb, icatconn: icatdb, configuration: config, nc: nc}
 }
 
+// Deprecated: call WithDETx instead.
 func (b *BothDatabases) DETx(ctx context.Context) (*DEDatabase, error) {
 	logStats("DE", b.deconn)
 	if b.detx != nil {
@@ -44,9 +58,8 @@ func (b *BothDatabases) DETx(ctx context.Context) (*DEDatabase, error) {
 	}
 
 	rb := func() {
-		alreadyDoneErr := "sql: transaction has already been committed or rolled back"
 		err := detx.Rollback()
-		if err != nil && err.Error() != alreadyDoneErr {
+		if err != nil && err != sql.ErrTxDone {
 			e := errors.Wrap(err, "Error rolling back DE database transaction")
 			log.Error(e)
 		}
@@ -75,6 +88,7 @@ func (b *BothDatabases) DETx(ctx context.Context) (*DEDatabase, error) {
 	return b.detx, nil
 }
 
+// Deprecated: call WithICATTx instead.
 func (b *BothDatabases) ICATTx(ctx context.Context) (*ICATDatabase, error) {
 	logStats("ICAT", b.icatconn)
 	if b.icattx != nil {
@@ -87,9 +101,8 @@ func (b *BothDatabases) ICATTx(ctx context.Context) (*ICATDatabase, error) {
 	}
 
 	rb := func() {
-		alreadyDoneErr := "sql: transaction has already been committed or rolled back"
 		err := icattx.Rollback()
-		if err != nil && err.Error() != alreadyDoneErr {
+		if err != nil && err != sql.ErrTxDone {
 			e := errors.Wrap(err, "Error rolling back ICAT transaction")
 			log.Error(e)
 		}
@@ -118,35 +131,231 @@ func (b *BothDatabases) ICATTx(ctx context.Context) (*ICATDatabase, error) {
 	return b.icattx, nil
 }
 
-func (b *BothDatabases) UpdateUserDataUsage(context context.Context, username string) (*natsconn.UserDataUsage, error) {
-	ctx, span := otel.Tracer(otelName).Start(context, "UpdateUserDataUsage")
-	defer span.End()
-
-	dedb, err := b.DETx(ctx)
+// WithDETx runs fn in a DE transaction scoped to this call, committing on a
+// nil return and rolling back otherwise. Unlike DETx/DECommit/DERollback, the
+// transaction is never cached on b, so this is safe to call concurrently.
+func (b *BothDatabases) WithDETx(ctx context.Context, fn func(*DEDatabase) error) (err error) {
+	tx, err := b.deconn.BeginTxx(ctx, nil)
 	if err != nil {
-		return nil, errors.Wrap(err, "Error creating DE transaction")
+		return errors.Wrap(err, "Error creating DE transaction")
 	}
-	defer b.DERollback()
 
-	icatdb, err := b.ICATTx(ctx)
+	defer func() {
+		if p := recover(); p != nil {
+			if rbErr := tx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+				log.Error(errors.Wrap(rbErr, "Error rolling back DE database transaction"))
+			}
+			panic(p)
+		}
+	}()
+
+	if err := fn(NewDE(tx, b.configuration)); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+			log.Error(errors.Wrap(rbErr, "Error rolling back DE database transaction"))
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "Error committing DE database transaction")
+	}
+
+	return nil
+}
+
+// icatTx is the subset of the value returned by DatabaseTxAccessor.BeginTxx
+// that withICATTxBody needs to manage a transaction's lifecycle.
+type icatTx interface {
+	Rollback() error
+	Commit() error
+}
+
+// withICATTxBody runs fn once tx has already been begun, committing on a nil
+// return and rolling back otherwise. It exists so WithICATTx and
+// WithICATSnapshotTx share the same commit/rollback handling.
+func withICATTxBody(tx icatTx, fn func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			if rbErr := tx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+				log.Error(errors.Wrap(rbErr, "Error rolling back ICAT transaction"))
+			}
+			panic(p)
+		}
+	}()
+
+	if err := fn(); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+			log.Error(errors.Wrap(rbErr, "Error rolling back ICAT transaction"))
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "Error committing ICAT transaction")
+	}
+
+	return nil
+}
+
+// WithICATTx runs fn in an ICAT transaction scoped to this call, committing
+// on a nil return and rolling back otherwise. Unlike ICATTx/ICATCommit/
+// ICATRollback, the transaction is never cached on b, so this is safe to
+// call concurrently.
+func (b *BothDatabases) WithICATTx(ctx context.Context, fn func(*ICATDatabase) error) error {
+	tx, err := b.icatconn.BeginTxx(ctx, nil)
 	if err != nil {
-		return nil, errors.Wrap(err, "Error creating ICAT transaction")
+		return errors.Wrap(err, "Error creating ICAT transaction")
 	}
-	defer b.ICATRollback()
 
-	userInfo, err := dedb.GetUserInfo(ctx, username)
+	return withICATTxBody(tx, func() error {
+		return fn(NewICAT(tx, b.configuration))
+	})
+}
+
+// WithICATSnapshotTx runs fn in a REPEATABLE READ, read-only ICAT
+// transaction, passing it a snapshot ID (from pg_export_snapshot() and
+// txid_current()) that callers can compare to recognize readings taken from
+// the same consistent view of ICAT.
+func (b *BothDatabases) WithICATSnapshotTx(ctx context.Context, fn func(*ICATDatabase, string) error) error {
+	tx, err := b.icatconn.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
 	if err != nil {
-		return nil, errors.Wrap(err, "error getting user info")
+		return errors.Wrap(err, "Error creating ICAT snapshot transaction")
 	}
 
-	usagenum, err := icatdb.UserCurrentDataUsage(ctx, username)
-	if err == sql.ErrNoRows {
-		usagenum = 0
-		log.Infof("No usage information was found for user %s. Attempting to add a usage of 0 anyway", username)
-	} else if err != nil {
-		return nil, errors.Wrap(err, "Error getting current data usage")
+	return withICATTxBody(tx, func() error {
+		var txid int64
+		var exported string
+		if err := tx.QueryRowContext(ctx, "SELECT txid_current(), pg_export_snapshot()").Scan(&txid, &exported); err != nil {
+			return errors.Wrap(err, "Error exporting ICAT snapshot")
+		}
+
+		return fn(NewICAT(tx, b.configuration), fmt.Sprintf("%d:%s", txid, exported))
+	})
+}
+
+// WithBothTx runs fn in a DE transaction and an ICAT transaction, committing
+// both on a nil return and rolling both back otherwise.
+func (b *BothDatabases) WithBothTx(ctx context.Context, fn func(*DEDatabase, *ICATDatabase) error) error {
+	return b.WithDETx(ctx, func(dedb *DEDatabase) error {
+		return b.WithICATTx(ctx, func(icatdb *ICATDatabase) error {
+			return fn(dedb, icatdb)
+		})
+	})
+}
+
+// isRetryablePGError reports whether err is a transient Postgres
+// serialization failure (40001), deadlock (40P01), or dropped connection.
+func isRetryablePGError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	cause := errors.Cause(err)
+
+	if cause == sql.ErrConnDone {
+		return true
+	}
+
+	if pqErr, ok := cause.(*pq.Error); ok {
+		switch pqErr.Code {
+		case "40001", "40P01":
+			return true
+		}
+	}
+
+	return false
+}
+
+// withRetry runs attempt, retrying with capped exponential backoff (based on
+// configuration.TxMaxRetries/TxRetryBaseDelay/TxRetryMaxDelay) as long as it
+// keeps returning a retryable Postgres error. label identifies the operation
+// in the retry log line.
+func (b *BothDatabases) withRetry(ctx context.Context, label string, attempt func() error) error {
+	maxAttempts := b.configuration.TxMaxRetries
+	baseDelay := b.configuration.TxRetryBaseDelay
+	maxDelay := b.configuration.TxRetryMaxDelay
+
+	var lastErr error
+	for i := 0; i < maxAttempts; i++ {
+		if i > 0 {
+			delay := baseDelay * time.Duration(math.Pow(2, float64(i-1)))
+			if delay > maxDelay {
+				delay = maxDelay
+			}
+			log.Warnf("retrying %s after retryable error (attempt %d/%d) in %s: %s", label, i+1, maxAttempts, delay, lastErr)
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		lastErr = attempt()
+		if lastErr == nil {
+			return nil
+		}
+
+		if !isRetryablePGError(lastErr) {
+			return lastErr
+		}
+	}
+
+	return errors.Wrap(lastErr, "exceeded max transaction retry attempts")
+}
+
+// RunInTx runs fn via WithBothTx, retrying with withRetry on a retryable
+// Postgres error.
+func (b *BothDatabases) RunInTx(ctx context.Context, fn func(*DEDatabase, *ICATDatabase) error) error {
+	return b.withRetry(ctx, "transaction", func() error {
+		return b.WithBothTx(ctx, fn)
+	})
+}
+
+// runDETx runs fn via WithDETx, retrying with withRetry on a retryable
+// Postgres error.
+func (b *BothDatabases) runDETx(ctx context.Context, fn func(*DEDatabase) error) error {
+	return b.withRetry(ctx, "DE transaction", func() error {
+		return b.WithDETx(ctx, fn)
+	})
+}
+
+// runICATTx runs fn via WithICATTx, retrying with withRetry on a retryable
+// Postgres error.
+func (b *BothDatabases) runICATTx(ctx context.Context, fn func(*ICATDatabase) error) error {
+	return b.withRetry(ctx, "ICAT transaction", func() error {
+		return b.WithICATTx(ctx, fn)
+	})
+}
+
+func (b *BothDatabases) UpdateUserDataUsage(context context.Context, username string) (*natsconn.UserDataUsage, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "UpdateUserDataUsage")
+	defer span.End()
+
+	var userID, userUsername string
+	var usagenum int64
+
+	err := b.RunInTx(ctx, func(dedb *DEDatabase, icatdb *ICATDatabase) error {
+		userInfo, err := dedb.GetUserInfo(ctx, username)
+		if err != nil {
+			return errors.Wrap(err, "error getting user info")
+		}
+		userID = userInfo.ID
+		userUsername = userInfo.Username
+
+		usagenum, err = icatdb.UserCurrentDataUsage(ctx, username)
+		if err == sql.ErrNoRows {
+			usagenum = 0
+			log.Infof("No usage information was found for user %s. Attempting to add a usage of 0 anyway", username)
+		} else if err != nil {
+			return errors.Wrap(err, "Error getting current data usage")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	b.ICATRollback()
 
 	log.Debugf("username %s; usage value %d", username, usagenum)
 	// if this update shouldn't be added, or should amend a prior reading, do it here or in the method called below
@@ -163,8 +372,8 @@ func (b *BothDatabases) UpdateUserDataUsage(context context.Context, username st
 		return nil, e
 	}
 
-	res.UserID = userInfo.ID
-	res.Username = userInfo.Username
+	res.UserID = userID
+	res.Username = userUsername
 
 	return res, err
 }
@@ -174,53 +383,166 @@ func (b *BothDatabases) UpdateUserDataUsageBatch(context context.Context, start,
 	defer span.End()
 
 	// should pass in qualified usernames, icatdb method will strip it as needed
-	icatdb, err := b.ICATTx(ctx)
-	if err != nil {
-		return nil, errors.Wrap(err, "Error creating ICAT transaction")
-	}
-	defer b.ICATRollback()
-
-	usages, err := icatdb.BatchCurrentDataUsage(ctx, start, end)
+	usages, snapshot, err := b.batchCurrentDataUsage(ctx, start, end)
 	if err != nil {
 		return nil, err
 	}
-	b.ICATRollback()
 
 	log.Tracef("usages in batch: %+v", usages)
 
-	var us []string
-	usagesFixed := make(map[string]float64)
+	usagesFixed := make(map[string]float64, len(usages))
 	for usr, usg := range usages { // keys of usages map
-		us = append(us, util.FixUsername(usr, b.configuration))
 		usagesFixed[util.FixUsername(usr, b.configuration)] = float64(usg)
 	}
 
-	dedb, err := b.DETx(ctx)
-	if err != nil {
-		return nil, errors.Wrap(err, "Error creating DE database transaction")
+	chunks := chunkUsages(usagesFixed, b.configuration.BatchChunkSize)
+
+	if snapshot == "" {
+		return b.processBatchChunks(ctx, nil, chunks)
 	}
-	defer b.DERollback()
 
-	if len(us) > 0 {
-		err = dedb.EnsureUsers(ctx, us)
-		if err != nil {
+	// The chunks were all read from the same ICAT snapshot, so defer the DE
+	// commit until every one of them has published, instead of each chunk
+	// committing on its own as processBatchChunks does outside SnapshotMode.
+	var res []*natsconn.UserDataUsage
+	err = b.runDETx(ctx, func(dedb *DEDatabase) error {
+		res, err = b.processBatchChunks(ctx, dedb, chunks)
+		return err
+	})
+	return res, err
+}
+
+// processBatchChunks fans chunks out across a bounded pool of workers, each
+// calling processBatchChunk. If dedb is nil, every worker opens and commits
+// its own DE transaction via runDETx; otherwise all workers share dedb and
+// none of them commits, leaving that to the caller.
+func (b *BothDatabases) processBatchChunks(ctx context.Context, dedb *DEDatabase, chunks []map[string]float64) ([]*natsconn.UserDataUsage, error) {
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(b.configuration.BatchConcurrency)
+
+	results := make([][]*natsconn.UserDataUsage, len(chunks))
+	for i, chunk := range chunks {
+		i, chunk := i, chunk
+		g.Go(func() error {
+			run := func(dedb *DEDatabase) error {
+				res, err := b.processBatchChunk(gctx, dedb, chunk)
+				if err != nil {
+					return err
+				}
+				results[i] = res
+				return nil
+			}
+			if dedb != nil {
+				return run(dedb)
+			}
+			return b.runDETx(gctx, run)
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	var res []*natsconn.UserDataUsage
+	for _, chunkRes := range results {
+		res = append(res, chunkRes...)
+	}
+
+	return res, nil
+}
+
+// batchCurrentDataUsage reads a batch's usages from ICAT. When
+// configuration.SnapshotMode is enabled, the read happens inside a
+// REPEATABLE READ, read-only transaction and the returned snapshot ID is
+// non-empty, which tells UpdateUserDataUsageBatch to defer its DE commit
+// until the whole batch has published instead of committing per chunk;
+// otherwise the returned snapshot ID is empty.
+//
+// The snapshot ID is used only for that choice; it is not attached to the
+// natsconn.UserDataUsage readings the batch returns.
+func (b *BothDatabases) batchCurrentDataUsage(ctx context.Context, start, end string) (map[string]int64, string, error) {
+	if !b.configuration.SnapshotMode {
+		var usages map[string]int64
+		err := b.runICATTx(ctx, func(icatdb *ICATDatabase) error {
+			u, err := icatdb.BatchCurrentDataUsage(ctx, start, end)
+			if err != nil {
+				return err
+			}
+			usages = u
+			return nil
+		})
+		return usages, "", err
+	}
+
+	var usages map[string]int64
+	var snapshot string
+	err := b.withRetry(ctx, "ICAT snapshot transaction", func() error {
+		return b.WithICATSnapshotTx(ctx, func(icatdb *ICATDatabase, snapshotID string) error {
+			u, err := icatdb.BatchCurrentDataUsage(ctx, start, end)
+			if err != nil {
+				return err
+			}
+			usages = u
+			snapshot = snapshotID
+			return nil
+		})
+	})
+	return usages, snapshot, err
+}
+
+// processBatchChunk ensures the DE user records exist for one chunk of a
+// batch using dedb, then publishes its usages via NATS. It is meant to be
+// called concurrently for multiple chunks of the same batch; dedb may be a
+// transaction scoped to this chunk alone or one shared with other chunks,
+// depending on the caller.
+func (b *BothDatabases) processBatchChunk(context context.Context, dedb *DEDatabase, chunk map[string]float64) ([]*natsconn.UserDataUsage, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "processBatchChunk")
+	defer span.End()
+
+	if len(chunk) > 0 {
+		us := make([]string, 0, len(chunk))
+		for user := range chunk {
+			us = append(us, user)
+		}
+
+		if err := dedb.EnsureUsers(ctx, us); err != nil {
 			return nil, errors.Wrap(err, "Error ensuring users exist")
 		}
 	} else {
 		log.Tracef("No users to be ensured in the batch")
 	}
 
-	err = b.DECommit()
-	if err != nil {
-		e := errors.Wrap(err, "Error committing DE transaction")
-		log.Error(e)
-		return nil, e
-	}
-
-	res, err := b.nc.AddUserUpdatesBatch(ctx, b.configuration, usagesFixed)
+	res, err := b.nc.AddUserUpdatesBatch(ctx, b.configuration, chunk)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error inserting new usage")
 	}
 
 	return res, nil
 }
+
+// chunkUsages splits fixed into sub-batches of at most size entries so
+// UpdateUserDataUsageBatch can fan a large batch out across a bounded
+// worker pool instead of publishing it as a single NATS request/response.
+func chunkUsages(fixed map[string]float64, size int) []map[string]float64 {
+	if size <= 0 {
+		size = len(fixed)
+	}
+
+	var chunks []map[string]float64
+	chunk := make(map[string]float64, size)
+	for user, usage := range fixed {
+		chunk[user] = usage
+		if len(chunk) >= size {
+			chunks = append(chunks, chunk)
+			chunk = make(map[string]float64, size)
+		}
+	}
+	// Always emit at least one chunk, even an empty one, so an empty usages
+	// map still results in a single AddUserUpdatesBatch call, matching the
+	// serial code this replaced.
+	if len(chunk) > 0 || len(chunks) == 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}